@@ -0,0 +1,392 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// cacheEntry is a single staged write in a CacheDB's overlay. Entries are
+// kept de-duplicated and sorted by key, so at most one entry exists per key
+// regardless of how many times it was written.
+type cacheEntry struct {
+	key   []byte
+	value []byte
+	kind  db.InternalKeyKind // Set, Delete, or Merge
+}
+
+// CacheDB is an in-memory write-buffer that can be layered on top of a DB.
+// It lets callers stage a speculative transaction -- any number of Set,
+// Delete, and Merge calls -- and later either apply it to the underlying DB
+// atomically with Write, or abandon it with Discard, without ever touching
+// the WAL for the intermediate state.
+type CacheDB struct {
+	db      *DB
+	cmp     db.Compare
+	merge   db.Merge
+	entries []cacheEntry
+}
+
+// CacheWrap returns a CacheDB layered on top of d.
+func (d *DB) CacheWrap() *CacheDB {
+	return &CacheDB{db: d, cmp: d.cmp, merge: d.merge}
+}
+
+// find returns the index of key's entry in c.entries, and whether it was
+// found. If not found, the index is where the entry should be inserted to
+// keep c.entries sorted.
+func (c *CacheDB) find(key []byte) (index int, ok bool) {
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return c.cmp(c.entries[i].key, key) >= 0
+	})
+	return i, i < len(c.entries) && c.cmp(c.entries[i].key, key) == 0
+}
+
+func (c *CacheDB) upsert(index int, ok bool, e cacheEntry) {
+	if ok {
+		c.entries[index] = e
+		return
+	}
+	c.entries = append(c.entries, cacheEntry{})
+	copy(c.entries[index+1:], c.entries[index:])
+	c.entries[index] = e
+}
+
+// Set stages key/value for Write, shadowing any earlier value key had in the
+// overlay or in the underlying DB.
+func (c *CacheDB) Set(key, value []byte) error {
+	index, ok := c.find(key)
+	c.upsert(index, ok, cacheEntry{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+		kind:  db.InternalKeyKindSet,
+	})
+	return nil
+}
+
+// Delete stages the deletion of key, shadowing any earlier value key had in
+// the overlay or in the underlying DB.
+func (c *CacheDB) Delete(key []byte) error {
+	index, ok := c.find(key)
+	c.upsert(index, ok, cacheEntry{
+		key:  append([]byte(nil), key...),
+		kind: db.InternalKeyKindDelete,
+	})
+	return nil
+}
+
+// Merge stages a merge operand for key. If the overlay already has a
+// pending Merge for key, the two are folded together immediately using the
+// same merge operator dbIter.mergeNext uses, and the result remains a
+// pending Merge to be combined with the underlying DB's value when an
+// iterator reads it. If the overlay instead has a Set or a Delete for key,
+// folding happens against that value but the result is stored as an
+// authoritative Set: just like mergeNext, a Set terminates the merge chain
+// and a Delete starts a fresh one, so in both cases the underlying DB's
+// value must never be merged in afterwards. With no existing entry, the
+// operand is left pending to be combined with the underlying DB's value.
+func (c *CacheDB) Merge(key, value []byte) error {
+	index, ok := c.find(key)
+	value = append([]byte(nil), value...)
+	kind := db.InternalKeyKindMerge
+	if ok {
+		switch c.entries[index].kind {
+		case db.InternalKeyKindSet:
+			value = c.merge(key, value, c.entries[index].value, nil)
+			kind = db.InternalKeyKindSet
+		case db.InternalKeyKindMerge:
+			value = c.merge(key, value, c.entries[index].value, nil)
+		case db.InternalKeyKindDelete:
+			kind = db.InternalKeyKindSet
+		}
+	}
+	c.upsert(index, ok, cacheEntry{key: append([]byte(nil), key...), value: value, kind: kind})
+	return nil
+}
+
+// Write atomically applies every staged entry to the underlying DB, in key
+// order, and clears the overlay. The CacheDB may be reused afterwards.
+func (c *CacheDB) Write() error {
+	if len(c.entries) == 0 {
+		return nil
+	}
+	b := c.db.NewBatch()
+	for _, e := range c.entries {
+		var err error
+		switch e.kind {
+		case db.InternalKeyKindSet:
+			err = b.Set(e.key, e.value, nil)
+		case db.InternalKeyKindDelete:
+			err = b.Delete(e.key, nil)
+		case db.InternalKeyKindMerge:
+			err = b.Merge(e.key, e.value, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.db.Apply(b, nil); err != nil {
+		return err
+	}
+	c.entries = c.entries[:0]
+	return nil
+}
+
+// Discard drops every staged entry without applying it to the underlying
+// DB. The CacheDB may be reused afterwards.
+func (c *CacheDB) Discard() {
+	c.entries = c.entries[:0]
+}
+
+// NewIter returns an iterator over the CacheDB's overlay merge-joined with a
+// dbIter over the underlying DB: for any given key, a Delete in the overlay
+// shadows whatever the underlying DB has, a Set in the overlay replaces it,
+// and a Merge in the overlay is combined with it using the merge operator.
+func (c *CacheDB) NewIter(o *db.IterOptions) Iterator {
+	base, _ := c.db.NewIter(o).(*dbIter)
+	return &cacheIter{c: c, base: base, cmp: c.cmp, merge: c.merge}
+}
+
+// cacheIter merge-joins a CacheDB's sorted overlay with a dbIter over the
+// underlying DB. Its key invariant, maintained by findNext/findPrev, is that
+// after any call the base iterator sits just past the returned key in
+// whichever direction was last traveled (base.Key() > key after findNext,
+// base.Key() < key after findPrev). Next/Prev reuse dbIterPos, exactly as
+// dbIter does for its own child iterator, to detect a change of direction
+// and step the base iterator back across the returned key before resuming.
+type cacheIter struct {
+	c     *CacheDB
+	base  *dbIter
+	cmp   db.Compare
+	merge db.Merge
+	key   []byte
+	value []byte
+	valid bool
+	err   error
+	pos   dbIterPos
+	// keyBuf and valueBuf hold copies of a base-sourced key/value, since the
+	// base iterator's own slices change once it is stepped past them.
+	keyBuf   []byte
+	valueBuf []byte
+}
+
+var _ Iterator = (*cacheIter)(nil)
+
+func (it *cacheIter) ovIndexGE(key []byte) int {
+	return sort.Search(len(it.c.entries), func(i int) bool { return it.cmp(it.c.entries[i].key, key) >= 0 })
+}
+
+func (it *cacheIter) ovIndexGT(key []byte) int {
+	return sort.Search(len(it.c.entries), func(i int) bool { return it.cmp(it.c.entries[i].key, key) > 0 })
+}
+
+// findNext scans forward from ovIdx (the overlay's next unconsidered entry)
+// and the base iterator's current position, returning the smaller of the
+// two keys (overlay breaking ties) with Deletes skipped and Merges combined
+// with the base's value.
+func (it *cacheIter) findNext(ovIdx int) bool {
+	it.valid = false
+	for {
+		hasOv := ovIdx < len(it.c.entries)
+		hasBase := it.base.Valid()
+		if !hasOv && !hasBase {
+			it.pos = dbIterNext
+			return false
+		}
+
+		useBase := !hasOv
+		if hasOv && hasBase {
+			c := it.cmp(it.c.entries[ovIdx].key, it.base.Key())
+			useBase = c > 0
+			if c == 0 {
+				// Tie: the overlay shadows the base entry.
+				useBase = false
+				if e := it.c.entries[ovIdx]; e.kind == db.InternalKeyKindMerge {
+					it.key, it.value = e.key, it.merge(e.key, e.value, it.base.Value(), nil)
+					it.valid = true
+				} else if e.kind == db.InternalKeyKindSet {
+					it.key, it.value = e.key, e.value
+					it.valid = true
+				}
+				ovIdx++
+				it.base.Next()
+				if !it.valid {
+					continue
+				}
+				it.pos = dbIterNext
+				return true
+			}
+		}
+
+		if useBase {
+			it.keyBuf = append(it.keyBuf[:0], it.base.Key()...)
+			it.valueBuf = append(it.valueBuf[:0], it.base.Value()...)
+			it.key, it.value = it.keyBuf, it.valueBuf
+			it.valid = true
+			it.base.Next()
+			it.pos = dbIterNext
+			return true
+		}
+
+		e := it.c.entries[ovIdx]
+		ovIdx++
+		if e.kind == db.InternalKeyKindDelete {
+			continue
+		}
+		it.key, it.value = e.key, e.value
+		it.valid = true
+		it.pos = dbIterNext
+		return true
+	}
+}
+
+// findPrev is the mirror image of findNext: ovIdx is an exclusive upper
+// bound, so the overlay's next unconsidered entry (walking backward) is
+// entries[ovIdx-1].
+func (it *cacheIter) findPrev(ovIdx int) bool {
+	it.valid = false
+	for {
+		hasOv := ovIdx > 0
+		hasBase := it.base.Valid()
+		if !hasOv && !hasBase {
+			it.pos = dbIterPrev
+			return false
+		}
+
+		useBase := !hasOv
+		if hasOv && hasBase {
+			c := it.cmp(it.c.entries[ovIdx-1].key, it.base.Key())
+			useBase = c < 0
+			if c == 0 {
+				useBase = false
+				if e := it.c.entries[ovIdx-1]; e.kind == db.InternalKeyKindMerge {
+					it.key, it.value = e.key, it.merge(e.key, e.value, it.base.Value(), nil)
+					it.valid = true
+				} else if e.kind == db.InternalKeyKindSet {
+					it.key, it.value = e.key, e.value
+					it.valid = true
+				}
+				ovIdx--
+				it.base.Prev()
+				if !it.valid {
+					continue
+				}
+				it.pos = dbIterPrev
+				return true
+			}
+		}
+
+		if useBase {
+			it.keyBuf = append(it.keyBuf[:0], it.base.Key()...)
+			it.valueBuf = append(it.valueBuf[:0], it.base.Value()...)
+			it.key, it.value = it.keyBuf, it.valueBuf
+			it.valid = true
+			it.base.Prev()
+			it.pos = dbIterPrev
+			return true
+		}
+
+		ovIdx--
+		e := it.c.entries[ovIdx]
+		if e.kind == db.InternalKeyKindDelete {
+			continue
+		}
+		it.key, it.value = e.key, e.value
+		it.valid = true
+		it.pos = dbIterPrev
+		return true
+	}
+}
+
+// fixBaseForward restores the forward invariant (base.Key() > it.key) after
+// the base iterator was last stepped backward.
+func (it *cacheIter) fixBaseForward() {
+	it.base.Next()
+	if it.base.Valid() && it.cmp(it.base.Key(), it.key) == 0 {
+		it.base.Next()
+	}
+}
+
+// fixBaseBackward restores the backward invariant (base.Key() < it.key)
+// after the base iterator was last stepped forward.
+func (it *cacheIter) fixBaseBackward() {
+	it.base.Prev()
+	if it.base.Valid() && it.cmp(it.base.Key(), it.key) == 0 {
+		it.base.Prev()
+	}
+}
+
+// SeekGE moves the iterator to the first key/value pair whose key is
+// greater than or equal to the given key.
+func (it *cacheIter) SeekGE(key []byte) {
+	it.base.SeekGE(key)
+	it.findNext(it.ovIndexGE(key))
+}
+
+// SeekLT moves the iterator to the last key/value pair whose key is less
+// than the given key.
+func (it *cacheIter) SeekLT(key []byte) {
+	it.base.SeekLT(key)
+	it.findPrev(it.ovIndexGE(key))
+}
+
+// First moves the iterator to the first key/value pair.
+func (it *cacheIter) First() {
+	it.base.First()
+	it.findNext(0)
+}
+
+// Last moves the iterator to the last key/value pair.
+func (it *cacheIter) Last() {
+	it.base.Last()
+	it.findPrev(len(it.c.entries))
+}
+
+// Next moves the iterator to the next key/value pair.
+func (it *cacheIter) Next() bool {
+	if it.pos == dbIterPrev {
+		it.fixBaseForward()
+	}
+	return it.findNext(it.ovIndexGT(it.key))
+}
+
+// Prev moves the iterator to the previous key/value pair.
+func (it *cacheIter) Prev() bool {
+	if it.pos == dbIterNext {
+		it.fixBaseBackward()
+	}
+	return it.findPrev(it.ovIndexGE(it.key))
+}
+
+// Key returns the key of the current key/value pair, or nil if done.
+func (it *cacheIter) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key/value pair, or nil if done.
+func (it *cacheIter) Value() []byte {
+	return it.value
+}
+
+// Valid returns true if the iterator is positioned at a valid key/value
+// pair.
+func (it *cacheIter) Valid() bool {
+	return it.valid
+}
+
+// Error returns any accumulated error.
+func (it *cacheIter) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.base.Error()
+}
+
+// Close closes the iterator and returns any accumulated error.
+func (it *cacheIter) Close() error {
+	return it.base.Close()
+}
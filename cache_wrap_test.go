@@ -0,0 +1,123 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+)
+
+func newTestCacheDB() *CacheDB {
+	return &CacheDB{cmp: db.Compare(testCmp), merge: db.Merge(testMerge)}
+}
+
+func TestCacheDBMergeKindTransitions(t *testing.T) {
+	// A Merge with no existing overlay entry stays pending, to be combined
+	// with the underlying DB's value by an iterator.
+	c := newTestCacheDB()
+	c.Merge([]byte("a"), []byte("x"))
+	if got, want := c.entries[0].kind, db.InternalKeyKindMerge; got != want {
+		t.Fatalf("kind = %v, want %v", got, want)
+	}
+	if got, want := string(c.entries[0].value), "x"; got != want {
+		t.Fatalf("value = %q, want %q", got, want)
+	}
+
+	// Folding a Merge onto an existing Set is authoritative: the base DB's
+	// value must never be merged in later, so the result is stored as a Set.
+	c = newTestCacheDB()
+	c.Set([]byte("a"), []byte("2"))
+	c.Merge([]byte("a"), []byte("3"))
+	if got, want := c.entries[0].kind, db.InternalKeyKindSet; got != want {
+		t.Fatalf("kind = %v, want %v", got, want)
+	}
+	if got, want := string(c.entries[0].value), "3,2"; got != want {
+		t.Fatalf("value = %q, want %q", got, want)
+	}
+
+	// Folding a Merge onto an existing Delete shadows the base DB entirely:
+	// the result is the operand alone, stored as an authoritative Set.
+	c = newTestCacheDB()
+	c.Delete([]byte("a"))
+	c.Merge([]byte("a"), []byte("3"))
+	if got, want := c.entries[0].kind, db.InternalKeyKindSet; got != want {
+		t.Fatalf("kind = %v, want %v", got, want)
+	}
+	if got, want := string(c.entries[0].value), "3"; got != want {
+		t.Fatalf("value = %q, want %q", got, want)
+	}
+
+	// Folding a Merge onto an existing pending Merge stays pending.
+	c = newTestCacheDB()
+	c.Merge([]byte("a"), []byte("x"))
+	c.Merge([]byte("a"), []byte("y"))
+	if got, want := c.entries[0].kind, db.InternalKeyKindMerge; got != want {
+		t.Fatalf("kind = %v, want %v", got, want)
+	}
+	if got, want := string(c.entries[0].value), "y,x"; got != want {
+		t.Fatalf("value = %q, want %q", got, want)
+	}
+}
+
+// TestCacheIterMergeShadowsBase is the exact scenario the reviewer reported:
+// a Set followed by a Merge in the overlay must never let the base DB's
+// value leak back in through cacheIter's tie-breaking branch.
+func TestCacheIterMergeShadowsBase(t *testing.T) {
+	c := newTestCacheDB()
+	c.Set([]byte("a"), []byte("2"))
+	c.Merge([]byte("a"), []byte("3"))
+
+	base := newTestDBIter([]fakeEntry{
+		{ik("a", 1, db.InternalKeyKindSet), []byte("1")},
+	}, nil, 0)
+	it := &cacheIter{c: c, base: base, cmp: c.cmp, merge: c.merge}
+	it.First()
+	if !it.Valid() {
+		t.Fatalf("expected a valid entry")
+	}
+	if got, want := string(it.Value()), "3,2"; got != want {
+		t.Fatalf("value = %q, want %q (the base DB's value must not leak in past the overlay's Set)", got, want)
+	}
+}
+
+// TestCacheIterDirectionChange exercises Next/Prev reversing direction
+// across both an overlay-sourced and a base-sourced key, which is exactly
+// the invariant fixBaseForward/fixBaseBackward exist to maintain.
+func TestCacheIterDirectionChange(t *testing.T) {
+	c := newTestCacheDB()
+	c.Set([]byte("b"), []byte("ov-b"))
+
+	base := newTestDBIter([]fakeEntry{
+		{ik("a", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("c", 1, db.InternalKeyKindSet), []byte("3")},
+	}, nil, 0)
+	it := &cacheIter{c: c, base: base, cmp: c.cmp, merge: c.merge}
+
+	it.SeekGE([]byte("a"))
+	if got, want := string(it.Key())+"="+string(it.Value()), "a=1"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	it.Next()
+	if got, want := string(it.Key())+"="+string(it.Value()), "b=ov-b"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	it.Next()
+	if got, want := string(it.Key())+"="+string(it.Value()), "c=3"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	it.Prev()
+	if got, want := string(it.Key())+"="+string(it.Value()), "b=ov-b"; got != want {
+		t.Fatalf("after reversing at c: got %s, want %s", got, want)
+	}
+	it.Prev()
+	if got, want := string(it.Key())+"="+string(it.Value()), "a=1"; got != want {
+		t.Fatalf("after reversing at b: got %s, want %s", got, want)
+	}
+	it.Next()
+	if got, want := string(it.Key())+"="+string(it.Value()), "b=ov-b"; got != want {
+		t.Fatalf("after re-reversing at a: got %s, want %s", got, want)
+	}
+}
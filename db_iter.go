@@ -5,6 +5,7 @@
 package pebble
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/petermattis/pebble/db"
@@ -31,10 +32,31 @@ const (
 // key/value pairs are not guaranteed to be a consistent snapshot of that DB
 // at a particular point in time.
 type dbIter struct {
-	opts      *db.IterOptions
-	cmp       db.Compare
-	merge     db.Merge
-	iter      internalIterator
+	opts  *db.IterOptions
+	cmp   db.Compare
+	merge db.Merge
+	iter  internalIterator
+	// rangeDelIter iterates over the fragmented, non-overlapping range
+	// tombstones visible to this iterator, merged across the memtables and
+	// every level by the version the iterator was constructed against. It is
+	// nil if there are no range tombstones to consider.
+	rangeDelIter internalIterator
+	// tombstone is the most recently located rangeDelIter fragment starting
+	// at or before the iterator's current position; its span need not
+	// contain that position, which covers checks. It remains
+	// valid, and is reused without reseeking rangeDelIter, for as long as
+	// findNextEntry/findPrevEntry stay within its [start, end) span.
+	tombstone rangeDelTombstone
+	// seqNum is the visible-sequence-number cutoff: internal keys (including
+	// range-deletion tombstones) with a larger sequence number were written
+	// after this iterator's view of the DB was established and must not be
+	// surfaced, or in a tombstone's case, allowed to cover anything. It is
+	// only meaningful when hasSeqNum is true; hasSeqNum is false for an
+	// iterator over the DB's current state, which has no cutoff at all, and
+	// true with seqNum set to the pinned sequence number for an iterator
+	// created via Snapshot.NewIter.
+	seqNum    uint64
+	hasSeqNum bool
 	version   *version
 	err       error
 	key       []byte
@@ -44,12 +66,117 @@ type dbIter struct {
 	valueBuf2 []byte
 	valid     bool
 	pos       dbIterPos
+	// prefix is the active prefix-iteration bound set by SeekPrefixGE, or
+	// nil if the iterator is not restricted to a prefix. prefixUpper is the
+	// lexicographic successor of prefix, used as an implicit upper bound.
+	prefix      []byte
+	prefixUpper []byte
 }
 
 var _ Iterator = (*dbIter)(nil)
 
-func (i *dbIter) findNextEntry() bool {
+// prefixIterator is an optional interface implemented by internalIterators
+// (such as table-level iterators backed by a bloom filter) that can use a
+// key prefix to skip whole sstables rather than scanning and discarding
+// non-matching keys in findNextEntry. SetPrefix(nil) disables the hint.
+type prefixIterator interface {
+	SetPrefix(prefix []byte)
+}
+
+// prefixSuccessor returns the smallest user key that is lexicographically
+// greater than every key with the given prefix, for use as an exclusive
+// upper bound. It returns nil if prefix has no successor (it is empty, or
+// consists entirely of 0xff bytes), in which case the scan is unbounded
+// above.
+func prefixSuccessor(prefix []byte) []byte {
+	dst := append([]byte(nil), prefix...)
+	for i := len(dst) - 1; i >= 0; i-- {
+		dst[i]++
+		if dst[i] != 0 {
+			return dst[:i+1]
+		}
+	}
+	return nil
+}
+
+// updateTombstone ensures i.tombstone reflects the rangeDelIter fragment (if
+// any) whose span covers key, reseeking rangeDelIter only when the cached
+// tombstone no longer applies. Because fragments are non-overlapping this is
+// correct regardless of whether the caller is walking forward or backward.
+func (i *dbIter) updateTombstone(key []byte) {
+	if i.rangeDelIter == nil {
+		return
+	}
+	if !i.tombstone.empty() &&
+		i.cmp(key, i.tombstone.start) >= 0 && i.cmp(key, i.tombstone.end) < 0 {
+		// key is still covered by the span of the cached tombstone.
+		return
+	}
+	i.seekTombstone(key)
+}
+
+// seekTombstone repositions rangeDelIter to the fragment, if any, that starts
+// at or before key, and caches it in i.tombstone. That fragment may end at or
+// before key, in which case it does not cover key.
+func (i *dbIter) seekTombstone(key []byte) {
+	i.rangeDelIter.SeekGE(key)
+	if i.rangeDelIter.Valid() {
+		if ik := i.rangeDelIter.Key(); i.cmp(ik.UserKey, key) == 0 {
+			i.tombstone = rangeDelTombstone{
+				start:  ik.UserKey,
+				end:    i.rangeDelIter.Value(),
+				seqNum: ik.SeqNum(),
+			}
+			return
+		}
+	}
+	i.rangeDelIter.SeekLT(key)
+	if !i.rangeDelIter.Valid() {
+		i.tombstone = rangeDelTombstone{}
+		return
+	}
+	ik := i.rangeDelIter.Key()
+	i.tombstone = rangeDelTombstone{
+		start:  ik.UserKey,
+		end:    i.rangeDelIter.Value(),
+		seqNum: ik.SeqNum(),
+	}
+}
+
+// coveredByTombstone reports whether key is deleted by a range tombstone
+// visible to this iterator. A tombstone written after the iterator's
+// visible-sequence-number cutoff is itself invisible and so cannot cover
+// anything, just as a point key written after the cutoff cannot be
+// surfaced.
+func (i *dbIter) coveredByTombstone(key db.InternalKey) bool {
+	if i.rangeDelIter == nil {
+		return false
+	}
+	i.updateTombstone(key.UserKey)
+	if i.hasSeqNum && i.tombstone.seqNum > i.seqNum {
+		return false
+	}
+	return i.tombstone.covers(i.cmp, key)
+}
+
+// visible reports whether key was written at or before the iterator's
+// visible-sequence-number cutoff, and so may be surfaced by this iterator.
+func (i *dbIter) visible(key db.InternalKey) bool {
+	return !i.hasSeqNum || key.SeqNum() <= i.seqNum
+}
+
+// effectiveUpperBound returns the iterator's upper bound, narrowed to
+// prefixUpper if a prefix scan is active and its bound is tighter.
+func (i *dbIter) effectiveUpperBound() []byte {
 	upperBound := i.opts.GetUpperBound()
+	if i.prefixUpper != nil && (upperBound == nil || i.cmp(i.prefixUpper, upperBound) < 0) {
+		upperBound = i.prefixUpper
+	}
+	return upperBound
+}
+
+func (i *dbIter) findNextEntry() bool {
+	upperBound := i.effectiveUpperBound()
 	i.valid = false
 	i.pos = dbIterCur
 
@@ -58,6 +185,12 @@ func (i *dbIter) findNextEntry() bool {
 		if upperBound != nil && i.cmp(key.UserKey, upperBound) >= 0 {
 			break
 		}
+		if !i.visible(key) {
+			// Written after this iterator's view of the DB was established;
+			// skip it as though it did not exist.
+			i.iter.Next()
+			continue
+		}
 
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
@@ -65,12 +198,17 @@ func (i *dbIter) findNextEntry() bool {
 			continue
 
 		case db.InternalKeyKindRangeDelete:
-			// Range deletions are treated as no-ops. See the comments in levelIter
-			// for more details.
+			// Range-deletion entries in the point-key stream are handled by
+			// rangeDelIter (see coveredByTombstone); they carry no value of
+			// their own here.
 			i.iter.Next()
 			continue
 
 		case db.InternalKeyKindSet:
+			if i.coveredByTombstone(key) {
+				i.nextUserKey()
+				continue
+			}
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
 			i.value = i.iter.Value()
@@ -78,6 +216,10 @@ func (i *dbIter) findNextEntry() bool {
 			return true
 
 		case db.InternalKeyKindMerge:
+			if i.coveredByTombstone(key) {
+				i.nextUserKey()
+				continue
+			}
 			return i.mergeNext(key)
 
 		default:
@@ -115,6 +257,12 @@ func (i *dbIter) findPrevEntry() bool {
 		if lowerBound != nil && i.cmp(key.UserKey, lowerBound) < 0 {
 			break
 		}
+		if !i.visible(key) {
+			// Written after this iterator's view of the DB was established;
+			// skip it as though it did not exist.
+			i.iter.Prev()
+			continue
+		}
 
 		if i.valid {
 			if i.cmp(key.UserKey, i.key) < 0 {
@@ -132,12 +280,19 @@ func (i *dbIter) findPrevEntry() bool {
 			continue
 
 		case db.InternalKeyKindRangeDelete:
-			// Range deletions are treated as no-ops. See the comments in levelIter
-			// for more details.
+			// Range-deletion entries in the point-key stream are handled by
+			// rangeDelIter (see coveredByTombstone); they carry no value of
+			// their own here.
 			i.iter.Prev()
 			continue
 
 		case db.InternalKeyKindSet:
+			if i.coveredByTombstone(key) {
+				i.value = nil
+				i.valid = false
+				i.iter.Prev()
+				continue
+			}
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
 			i.value = i.iter.Value()
@@ -146,6 +301,12 @@ func (i *dbIter) findPrevEntry() bool {
 			continue
 
 		case db.InternalKeyKindMerge:
+			if i.coveredByTombstone(key) {
+				i.value = nil
+				i.valid = false
+				i.iter.Prev()
+				continue
+			}
 			if !i.valid {
 				i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 				i.key = i.keyBuf
@@ -215,6 +376,19 @@ func (i *dbIter) mergeNext(key db.InternalKey) bool {
 			i.pos = dbIterNext
 			return true
 		}
+		if !i.visible(key) {
+			// Written after this iterator's view of the DB was established;
+			// skip it and keep looking for an older, visible version to
+			// merge.
+			continue
+		}
+		if i.coveredByTombstone(key) {
+			// A range tombstone with a higher sequence number than this key
+			// covers it, just like a point deletion. Terminate the merge
+			// chain and return everything accumulated up to this point.
+			return true
+		}
+
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
 			// We've hit a deletion tombstone. Return everything up to this
@@ -222,8 +396,9 @@ func (i *dbIter) mergeNext(key db.InternalKey) bool {
 			return true
 
 		case db.InternalKeyKindRangeDelete:
-			// Range deletions are treated as no-ops. See the comments in levelIter
-			// for more details.
+			// Range-deletion entries in the point-key stream are handled by
+			// rangeDelIter (see coveredByTombstone); they carry no value of
+			// their own here.
 			continue
 
 		case db.InternalKeyKindSet:
@@ -245,12 +420,58 @@ func (i *dbIter) mergeNext(key db.InternalKey) bool {
 	}
 }
 
+// disablePrefix clears any prefix-iteration bound set by a prior
+// SeekPrefixGE call. It is called by every seek/positioning method that
+// isn't SeekPrefixGE itself, so that prefix mode never outlives the call
+// that established it.
+func (i *dbIter) disablePrefix() {
+	if i.prefix == nil && i.prefixUpper == nil {
+		return
+	}
+	i.prefix = nil
+	i.prefixUpper = nil
+	if pi, ok := i.iter.(prefixIterator); ok {
+		pi.SetPrefix(nil)
+	}
+}
+
 // SeekGE moves the iterator to the first key/value pair whose key is greater
 // than or equal to the given key.
 func (i *dbIter) SeekGE(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.disablePrefix()
+
+	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
+		key = lowerBound
+	}
+
+	i.iter.SeekGE(key)
+	i.findNextEntry()
+}
+
+// SeekPrefixGE moves the iterator to the first key/value pair whose key is
+// greater than or equal to the given key, and restricts iteration to keys
+// sharing prefix: SeekPrefixGE itself rejects a key that doesn't match the
+// prefix, and subsequent Next calls stop once the prefix is exhausted. The
+// restriction lasts until the next call to SeekGE, SeekLT, SeekPrefixGE,
+// First, or Last.
+//
+// prefix must be a prefix of key. If the underlying internalIterator
+// understands prefixes (e.g. it can consult a bloom filter keyed on the
+// prefix), it is given the chance to skip sstables that cannot contain a
+// match instead of scanning and discarding their keys in findNextEntry.
+func (i *dbIter) SeekPrefixGE(prefix, key []byte) {
+	if i.err != nil {
+		return
+	}
+
+	i.prefix = append(i.prefix[:0], prefix...)
+	i.prefixUpper = prefixSuccessor(i.prefix)
+	if pi, ok := i.iter.(prefixIterator); ok {
+		pi.SetPrefix(i.prefix)
+	}
 
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
 		key = lowerBound
@@ -258,6 +479,9 @@ func (i *dbIter) SeekGE(key []byte) {
 
 	i.iter.SeekGE(key)
 	i.findNextEntry()
+	if i.valid && !bytes.HasPrefix(i.key, i.prefix) {
+		i.valid = false
+	}
 }
 
 // SeekLT moves the iterator to the last key/value pair whose key is less than
@@ -266,6 +490,7 @@ func (i *dbIter) SeekLT(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.disablePrefix()
 
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil && i.cmp(key, upperBound) >= 0 {
 		key = upperBound
@@ -280,6 +505,7 @@ func (i *dbIter) First() {
 	if i.err != nil {
 		return
 	}
+	i.disablePrefix()
 
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil {
 		i.SeekGE(lowerBound)
@@ -295,6 +521,7 @@ func (i *dbIter) Last() {
 	if i.err != nil {
 		return
 	}
+	i.disablePrefix()
 
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil {
 		i.SeekLT(upperBound)
@@ -339,6 +566,134 @@ func (i *dbIter) Prev() bool {
 	return i.findPrevEntry()
 }
 
+// scanNextUserKey advances i.iter, currently positioned at a valid entry,
+// past every remaining internal key sharing that entry's user key, leaving
+// it positioned at the next distinct user key (or exhausted). It is Scan's
+// zero-copy counterpart to nextUserKey, and unlike nextUserKey it does not
+// depend on or update i.key/i.valid.
+//
+// The current user key is copied into i.keyBuf before i.iter is advanced:
+// i.iter.Key().UserKey is only valid until the next call to i.iter.Next(),
+// so comparing against it directly across iterations would risk comparing
+// a buffer against itself after it has been overwritten in place.
+func (i *dbIter) scanNextUserKey() {
+	userKey := append(i.keyBuf[:0], i.iter.Key().UserKey...)
+	i.keyBuf = userKey
+	for i.iter.Next() {
+		if i.cmp(userKey, i.iter.Key().UserKey) != 0 {
+			return
+		}
+	}
+}
+
+// Scan visits each key/value pair in key order starting from the iterator's
+// current position, calling fn for each until fn returns false, the
+// iterator is exhausted, or an error occurs. It must be called after a
+// SeekGE, SeekLT, First, or Last has established that position; calling it
+// on a freshly constructed, unpositioned iterator visits nothing.
+//
+// Scan is meant to be the sole driver of the iterator from that point on.
+// It does not update i.key/i.value/i.valid for Set entries — doing so would
+// reintroduce the very copies it exists to avoid — and only a Merge entry,
+// resolved through mergeNext, sets them, so once Scan has walked
+// past the entry the iterator was positioned at, Key/Value/Valid/Next/Prev
+// no longer reflect where Scan stopped. Call SeekGE/First/etc. again (or
+// start a new Scan) before resuming iteration through those methods.
+//
+// Unlike Key/Value, whose returned slices must remain valid until the next
+// call, the slices passed to fn are only guaranteed valid for the duration
+// of that call. For the common Set case this lets Scan hand fn the
+// underlying sstable block's bytes directly, skipping the
+// append(keyBuf[:0], ...) copies findNextEntry makes to satisfy Key/Value's
+// stability contract. Merge results still require buffering, since they're
+// computed by combining multiple stored values rather than read directly
+// off a block.
+func (i *dbIter) Scan(fn func(key, value []byte) bool) error {
+	if i.err != nil {
+		return i.err
+	}
+
+	if i.valid {
+		// The iterator is already sitting on a resolved entry from a prior
+		// SeekGE/SeekLT/First/Last/Next/Prev call. Deliver it before
+		// falling through to the raw i.iter loop below, then step i.iter
+		// past it exactly the way Next() would: a Set resolution leaves
+		// i.iter sitting directly on the entry (pos == dbIterCur), while a
+		// Merge resolution has already advanced i.iter past it (pos ==
+		// dbIterNext). Stepping unconditionally here would skip a key in
+		// the Merge case or re-emit one in the Set case.
+		if !fn(i.key, i.value) {
+			return nil
+		}
+		switch i.pos {
+		case dbIterCur:
+			i.nextUserKey()
+		case dbIterPrev:
+			i.nextUserKey()
+			i.nextUserKey()
+		case dbIterNext:
+		}
+	}
+
+	upperBound := i.effectiveUpperBound()
+
+	for i.iter.Valid() {
+		key := i.iter.Key()
+		if upperBound != nil && i.cmp(key.UserKey, upperBound) >= 0 {
+			break
+		}
+		if !i.visible(key) {
+			i.iter.Next()
+			continue
+		}
+
+		switch key.Kind() {
+		case db.InternalKeyKindDelete:
+			i.scanNextUserKey()
+			continue
+
+		case db.InternalKeyKindRangeDelete:
+			i.iter.Next()
+			continue
+
+		case db.InternalKeyKindSet:
+			if i.coveredByTombstone(key) {
+				i.scanNextUserKey()
+				continue
+			}
+			userKey, value := key.UserKey, i.iter.Value()
+			if !fn(userKey, value) {
+				return nil
+			}
+			i.scanNextUserKey()
+
+		case db.InternalKeyKindMerge:
+			if i.coveredByTombstone(key) {
+				i.scanNextUserKey()
+				continue
+			}
+			if !i.mergeNext(key) {
+				return i.err
+			}
+			if !fn(i.key, i.value) {
+				return nil
+			}
+			// mergeNext leaves i.iter on the Set, Delete, or covered entry that
+			// ended the merge chain, if any; step past the rest of this user
+			// key.
+			if i.iter.Valid() && i.cmp(i.iter.Key().UserKey, i.key) == 0 {
+				i.scanNextUserKey()
+			}
+
+		default:
+			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
+			return i.err
+		}
+	}
+
+	return nil
+}
+
 // Key returns the key of the current key/value pair, or nil if done. The
 // caller should not modify the contents of the returned slice, and its
 // contents may change on the next call to Next.
@@ -376,5 +731,10 @@ func (i *dbIter) Close() error {
 	if err := i.iter.Close(); err != nil && i.err != nil {
 		i.err = err
 	}
+	if i.rangeDelIter != nil {
+		if err := i.rangeDelIter.Close(); err != nil && i.err == nil {
+			i.err = err
+		}
+	}
 	return i.err
 }
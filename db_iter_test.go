@@ -0,0 +1,299 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// fakeEntry is one internal key/value pair served by a fakeIter.
+type fakeEntry struct {
+	key   db.InternalKey
+	value []byte
+}
+
+// fakeIter is a minimal internalIterator backed by an in-memory, pre-sorted
+// slice of entries. It exists purely to drive dbIter/cacheIter in tests
+// without a real memtable/sstable stack.
+type fakeIter struct {
+	cmp     db.Compare
+	entries []fakeEntry
+	pos     int
+}
+
+func (f *fakeIter) Valid() bool         { return f.pos >= 0 && f.pos < len(f.entries) }
+func (f *fakeIter) Key() db.InternalKey { return f.entries[f.pos].key }
+func (f *fakeIter) Value() []byte       { return f.entries[f.pos].value }
+func (f *fakeIter) Next() bool          { f.pos++; return f.Valid() }
+func (f *fakeIter) Prev() bool          { f.pos--; return f.Valid() }
+func (f *fakeIter) Close() error        { return nil }
+
+func (f *fakeIter) First() { f.pos = 0 }
+func (f *fakeIter) Last()  { f.pos = len(f.entries) - 1 }
+
+func (f *fakeIter) SeekGE(key []byte) {
+	f.pos = sort.Search(len(f.entries), func(i int) bool {
+		return f.cmp(f.entries[i].key.UserKey, key) >= 0
+	})
+}
+
+func (f *fakeIter) SeekLT(key []byte) {
+	f.pos = sort.Search(len(f.entries), func(i int) bool {
+		return f.cmp(f.entries[i].key.UserKey, key) >= 0
+	}) - 1
+}
+
+var _ internalIterator = (*fakeIter)(nil)
+
+func testCmp(a, b []byte) int { return bytes.Compare(a, b) }
+
+// testMerge concatenates operands with a comma, newest first, which is
+// enough to distinguish fold order in assertions below.
+func testMerge(key, value1, value2, buf []byte) []byte {
+	return append(append(append(buf[:0], value1...), ','), value2...)
+}
+
+// newTestDBIter builds a dbIter over entries/rangeDel. A seqNum of 0 means
+// "no snapshot cutoff" (hasSeqNum is left false), matching an iterator over
+// the DB's live state; a test that needs a real, pinned cutoff of 0 should
+// set hasSeqNum directly instead of going through this helper.
+func newTestDBIter(entries, rangeDel []fakeEntry, seqNum uint64) *dbIter {
+	i := &dbIter{
+		opts:      &db.IterOptions{},
+		cmp:       db.Compare(testCmp),
+		merge:     db.Merge(testMerge),
+		iter:      &fakeIter{cmp: db.Compare(testCmp), entries: entries, pos: -1},
+		seqNum:    seqNum,
+		hasSeqNum: seqNum != 0,
+	}
+	if rangeDel != nil {
+		i.rangeDelIter = &fakeIter{cmp: db.Compare(testCmp), entries: rangeDel, pos: -1}
+	}
+	return i
+}
+
+func ik(userKey string, seqNum uint64, kind db.InternalKeyKind) db.InternalKey {
+	return db.MakeInternalKey([]byte(userKey), seqNum, kind)
+}
+
+func TestDBIterRangeDeleteForwardAndBackward(t *testing.T) {
+	entries := []fakeEntry{
+		{ik("a", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("b", 2, db.InternalKeyKindSet), []byte("2")}, // covered by the tombstone below
+		{ik("c", 1, db.InternalKeyKindSet), []byte("3")}, // end key of the tombstone, exclusive: not covered
+	}
+	// [b, c) written at seqNum 5 shadows "b"@2 but not "a"@1 or "c"@1.
+	rangeDel := []fakeEntry{
+		{ik("b", 5, db.InternalKeyKindRangeDelete), []byte("c")},
+	}
+
+	it := newTestDBIter(entries, rangeDel, 0)
+	it.First()
+	var forward []string
+	for it.Valid() {
+		forward = append(forward, string(it.Key())+"="+string(it.Value()))
+		it.Next()
+	}
+	want := []string{"a=1", "c=3"}
+	if !reflect.DeepEqual(forward, want) {
+		t.Fatalf("forward = %v, want %v", forward, want)
+	}
+
+	it = newTestDBIter(entries, rangeDel, 0)
+	it.Last()
+	var backward []string
+	for it.Valid() {
+		backward = append(backward, string(it.Key())+"="+string(it.Value()))
+		it.Prev()
+	}
+	wantBack := []string{"c=3", "a=1"}
+	if !reflect.DeepEqual(backward, wantBack) {
+		t.Fatalf("backward = %v, want %v", backward, wantBack)
+	}
+}
+
+func TestDBIterRangeDeleteTerminatesMergeChain(t *testing.T) {
+	entries := []fakeEntry{
+		{ik("d", 3, db.InternalKeyKindMerge), []byte("x")},
+		{ik("d", 1, db.InternalKeyKindMerge), []byte("y")},
+	}
+	// Tombstone at seqNum 2 covers only d@1, so the merge chain must stop
+	// there without folding in "y".
+	rangeDel := []fakeEntry{
+		{ik("d", 2, db.InternalKeyKindRangeDelete), []byte("e")},
+	}
+
+	it := newTestDBIter(entries, rangeDel, 0)
+	it.First()
+	if !it.Valid() {
+		t.Fatalf("expected a valid entry")
+	}
+	if got, want := string(it.Value()), "x"; got != want {
+		t.Fatalf("value = %q, want %q (the tombstone should have cut off the merge chain)", got, want)
+	}
+}
+
+func TestDBIterSnapshotVisibility(t *testing.T) {
+	entries := []fakeEntry{
+		{ik("a", 3, db.InternalKeyKindSet), []byte("3")}, // written after the snapshot
+		{ik("a", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("b", 5, db.InternalKeyKindSet), []byte("5")}, // entire key written after the snapshot
+	}
+
+	it := newTestDBIter(entries, nil, 2)
+	it.First()
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+		it.Next()
+	}
+	want := []string{"a=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestDBIterSnapshotVisibilityRangeTombstone covers a DeleteRange written to
+// the DB after a snapshot was taken: the tombstone's own seqNum exceeds the
+// snapshot's cutoff, so it must not be able to cover anything the snapshot
+// can see, exactly like a point key written after the cutoff.
+func TestDBIterSnapshotVisibilityRangeTombstone(t *testing.T) {
+	entries := []fakeEntry{
+		{ik("b", 2, db.InternalKeyKindSet), []byte("2")},
+	}
+	// DeleteRange[a, c) written at seqNum 6, after the snapshot@4 below.
+	rangeDel := []fakeEntry{
+		{ik("a", 6, db.InternalKeyKindRangeDelete), []byte("c")},
+	}
+
+	it := newTestDBIter(entries, rangeDel, 4)
+	it.First()
+	if !it.Valid() {
+		t.Fatalf("expected b=2 to still be visible; a DeleteRange written after the snapshot must not suppress it")
+	}
+	if got, want := string(it.Key())+"="+string(it.Value()), "b=2"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+		isNil  bool
+	}{
+		{prefix: "ab", want: "ac"},
+		{prefix: "a\xff", want: "b"},
+		{prefix: "\xff\xff", isNil: true},
+		{prefix: "", isNil: true},
+	}
+	for _, tc := range tests {
+		got := prefixSuccessor([]byte(tc.prefix))
+		if tc.isNil {
+			if got != nil {
+				t.Errorf("prefixSuccessor(%q) = %q, want nil", tc.prefix, got)
+			}
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("prefixSuccessor(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestDBIterSeekPrefixGE(t *testing.T) {
+	entries := []fakeEntry{
+		{ik("ab", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("ac", 1, db.InternalKeyKindSet), []byte("2")},
+		{ik("b", 1, db.InternalKeyKindSet), []byte("3")},
+	}
+
+	it := newTestDBIter(entries, nil, 0)
+	it.SeekPrefixGE([]byte("a"), []byte("a"))
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key()))
+		it.Next()
+	}
+	want := []string{"ab", "ac"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v (the \"b\" key has a different prefix and must not be scanned)", got, want)
+	}
+
+	// A SeekGE that lands past the end of the requested prefix must leave
+	// the iterator invalid, whether it's caught by the implicit upper bound
+	// or by the explicit HasPrefix check at the end of SeekPrefixGE.
+	entries2 := []fakeEntry{
+		{ik("xa", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("xc", 1, db.InternalKeyKindSet), []byte("2")},
+	}
+	it2 := newTestDBIter(entries2, nil, 0)
+	it2.SeekPrefixGE([]byte("xb"), []byte("xb"))
+	if it2.Valid() {
+		t.Fatalf("expected SeekPrefixGE(%q) to find nothing, got %q", "xb", it2.Key())
+	}
+}
+
+func TestDBIterScanResumesFromResolvedEntry(t *testing.T) {
+	// The current entry resolves via the Set path, which leaves the raw
+	// iterator sitting directly on it (as opposed to Merge, which already
+	// advances past it). Scan must deliver it exactly once either way.
+	entries := []fakeEntry{
+		{ik("a", 1, db.InternalKeyKindSet), []byte("1")},
+		{ik("b", 1, db.InternalKeyKindSet), []byte("2")},
+		{ik("c", 1, db.InternalKeyKindSet), []byte("3")},
+	}
+	it := newTestDBIter(entries, nil, 0)
+	it.First()
+
+	var got []string
+	if err := it.Scan(func(key, value []byte) bool {
+		got = append(got, string(key)+"="+string(value))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a=1", "b=2", "c=3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The Merge path: mergeNext has already stepped the raw iterator past
+	// "a" by the time Scan is invoked.
+	mergeEntries := []fakeEntry{
+		{ik("a", 1, db.InternalKeyKindMerge), []byte("x")},
+		{ik("b", 1, db.InternalKeyKindSet), []byte("2")},
+	}
+	it = newTestDBIter(mergeEntries, nil, 0)
+	it.First()
+	got = nil
+	if err := it.Scan(func(key, value []byte) bool {
+		got = append(got, string(key)+"="+string(value))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"a=x", "b=2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Stopping on the already-resolved entry must not advance past it.
+	it = newTestDBIter(entries, nil, 0)
+	it.First()
+	calls := 0
+	it.Scan(func(key, value []byte) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+}
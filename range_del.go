@@ -0,0 +1,32 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// rangeDelTombstone is a single fragment produced by the range-deletion
+// fragmenter: a [start, end) span together with the sequence number of the
+// DeleteRange that wrote it. Fragments handed to dbIter never overlap, so at
+// most one tombstone can cover any given user key.
+type rangeDelTombstone struct {
+	start  []byte
+	end    []byte
+	seqNum uint64
+}
+
+// empty returns true if t does not represent a tombstone.
+func (t rangeDelTombstone) empty() bool {
+	return t.end == nil
+}
+
+// covers returns true if t deletes key: key falls within [t.start, t.end)
+// and the tombstone was written after key, so key must not be surfaced to a
+// reader that can see the tombstone.
+func (t rangeDelTombstone) covers(cmp db.Compare, key db.InternalKey) bool {
+	if t.empty() || t.seqNum <= key.SeqNum() {
+		return false
+	}
+	return cmp(key.UserKey, t.start) >= 0 && cmp(key.UserKey, t.end) < 0
+}
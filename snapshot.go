@@ -0,0 +1,117 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// Snapshot provides a read-only point-in-time view of the DB state. Iterators
+// created from a snapshot observe the same state the DB was in when the
+// snapshot was created: later writes to the DB are invisible to them, and
+// compactions will not discard any data the snapshot can still see.
+//
+// Snapshots must be closed when no longer needed, or they will pin the
+// version (and anything it references) from being garbage collected.
+type Snapshot struct {
+	db      *DB
+	seqNum  uint64
+	version *version
+
+	// prev and next link this snapshot into its DB's list of open snapshots, so that
+	// compactions can find the oldest sequence number that still must be
+	// preserved.
+	prev, next *Snapshot
+}
+
+// NewSnapshot returns a point-in-time view of the current DB state. Iterators
+// created from the snapshot will not see subsequent writes to the DB made
+// after NewSnapshot returns.
+func (d *DB) NewSnapshot() *Snapshot {
+	d.mu.Lock()
+	s := &Snapshot{
+		db:      d,
+		seqNum:  atomic.LoadUint64(&d.mu.versions.visibleSeqNum),
+		version: d.mu.versions.currentVersion(),
+	}
+	s.version.ref()
+	d.mu.snapshots.pushBack(s)
+	d.mu.Unlock()
+	return s
+}
+
+// NewIter returns an iterator over the DB state as of the time the snapshot
+// was created. The returned iterator must be closed before the snapshot
+// itself is closed.
+func (s *Snapshot) NewIter(o *db.IterOptions) Iterator {
+	s.version.ref()
+	return &dbIter{
+		opts:         o,
+		cmp:          s.db.cmp,
+		merge:        s.db.merge,
+		iter:         s.version.newIter(o),
+		rangeDelIter: s.version.newRangeDelIter(o),
+		version:      s.version,
+		seqNum:       s.seqNum,
+		hasSeqNum:    true,
+	}
+}
+
+// Close releases the resources held by the snapshot, allowing compactions to
+// once again drop tombstones and superseded versions of keys the snapshot
+// was the last to reference.
+func (s *Snapshot) Close() error {
+	if s.db == nil {
+		// Already closed.
+		return nil
+	}
+	s.db.mu.Lock()
+	s.db.mu.snapshots.remove(s)
+	s.db.mu.Unlock()
+	s.version.unref()
+	s.db = nil
+	return nil
+}
+
+// snapshotList is an intrusive doubly-linked list of live snapshots, ordered
+// by creation time. It is used to find the oldest sequence number a
+// compaction must preserve data for.
+type snapshotList struct {
+	root Snapshot
+}
+
+func (l *snapshotList) init() {
+	l.root.prev = &l.root
+	l.root.next = &l.root
+}
+
+func (l *snapshotList) empty() bool {
+	return l.root.next == &l.root
+}
+
+func (l *snapshotList) pushBack(s *Snapshot) {
+	s.prev = l.root.prev
+	s.next = &l.root
+	s.prev.next = s
+	s.next.prev = s
+}
+
+func (l *snapshotList) remove(s *Snapshot) {
+	s.prev.next = s.next
+	s.next.prev = s.prev
+	s.prev = nil
+	s.next = nil
+}
+
+// oldest returns the sequence number of the oldest live snapshot, or the
+// supplied seqNum if there are no live snapshots.
+func (l *snapshotList) oldest(seqNum uint64) uint64 {
+	if l.empty() {
+		return seqNum
+	}
+	return l.root.next.seqNum
+}